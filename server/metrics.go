@@ -0,0 +1,60 @@
+// This file defines the Prometheus metrics exported on /metrics: command
+// counts by type and outcome, retry counts, device round-trip latency,
+// queue depth, and parser errors. It exists to make the retry-on-timeout
+// behavior hidden inside commandHandler.Open observable from the outside.
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// commandsTotal counts every command attempt, by device, command type
+	// (read/write), and outcome (ack/nak/error/timeout). Outcomes are
+	// mutually exclusive per attempt; summing them gives the total number
+	// of attempts made. Attempts that are retried are additionally counted
+	// by commandRetriesTotal, so that counter overlaps with this one by
+	// design rather than double-counting within it.
+	commandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "evolutionhttp_commands_total",
+		Help: "Total number of commands processed, by device, type, and outcome.",
+	}, []string{"device", "type", "outcome"})
+
+	// commandRetriesTotal counts attempts that failed and were followed by
+	// another attempt (i.e. excludes the final, permanently-failed
+	// attempt), by device and command type.
+	commandRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "evolutionhttp_command_retries_total",
+		Help: "Total number of command attempts that failed and were retried, by device and type.",
+	}, []string{"device", "type"})
+
+	// deviceLatencySeconds measures the time from writing a command to
+	// receiving (and parsing) its response, per device.
+	deviceLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "evolutionhttp_device_round_trip_seconds",
+		Help:    "Device round-trip latency for a single command execution.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"device"})
+
+	// pendingOpsGauge tracks queue depth, per device and queue (read/write).
+	pendingOpsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "evolutionhttp_pending_ops",
+		Help: "Number of operations currently queued, by device and queue.",
+	}, []string{"device", "queue"})
+
+	// parseErrorsTotal counts device responses that failed to parse, per
+	// device (separate from a NAK, which parses cleanly as a rejection).
+	parseErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "evolutionhttp_parse_errors_total",
+		Help: "Total number of device responses that failed to parse.",
+	}, []string{"device"})
+)
+
+// cmdType labels a command as "read" or "write" for metrics.
+func cmdType(cmd evoRequest) string {
+	if cmd.isWrite() {
+		return "write"
+	}
+	return "read"
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCmdType(t *testing.T) {
+	if got := cmdType(evoRequest("S1Z1RT")); got != "read" {
+		t.Errorf("cmdType(read command) = %q, want %q", got, "read")
+	}
+	if got := cmdType(evoRequest("S1Z1FAN!ON")); got != "write" {
+		t.Errorf("cmdType(write command) = %q, want %q", got, "write")
+	}
+}
+
+// TestCommandMetrics drives one retried-then-successful read through
+// commandHandler and asserts commandsTotal/commandRetriesTotal reflect it,
+// guarding against a regression to double-counting retried attempts (c2ff503).
+func TestCommandMetrics(t *testing.T) {
+	const device = "metrics-test-device"
+
+	fakeDevice := newFakeDevice()
+	fakeDevice.start()
+
+	handler := new(commandHandler)
+	handler.name = device
+	handler.Open(fakeDevice)
+
+	before := testutil.ToFloat64(commandRetriesTotal.WithLabelValues(device, "read"))
+
+	resultCh, _ := handler.addOp("S1Z1RT?")
+
+	// First attempt: an unparseable response forces a retry.
+	cmd := <-fakeDevice.testCommandChan
+	if cmd != "S1Z1RT?" {
+		t.Fatalf("Expected 'S1Z1RT?', got %q", cmd)
+	}
+	fakeDevice.testResponseChan <- "garbage"
+
+	// Second attempt: succeeds.
+	cmd = <-fakeDevice.testCommandChan
+	if cmd != "S1Z1RT?" {
+		t.Fatalf("Expected retried command 'S1Z1RT?', got %q", cmd)
+	}
+	fakeDevice.testResponseChan <- "S1Z1RT:72\xF8F"
+
+	result := <-resultCh
+	if result.err != nil {
+		t.Fatalf("Expected command to eventually succeed, got err %v", result.err)
+	}
+
+	if got, want := testutil.ToFloat64(commandRetriesTotal.WithLabelValues(device, "read"))-before, 1.0; got != want {
+		t.Errorf("commandRetriesTotal delta = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(commandsTotal.WithLabelValues(device, "read", "ack")), 1.0; got != want {
+		t.Errorf("commandsTotal{outcome=ack} = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(commandsTotal.WithLabelValues(device, "read", "error")), 1.0; got != want {
+		t.Errorf("commandsTotal{outcome=error} = %v, want %v", got, want)
+	}
+}
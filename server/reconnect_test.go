@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeReopener is a minimal deviceIo + reopener test double that fails its
+// first Reopen call and succeeds thereafter.
+type fakeReopener struct {
+	deviceIo
+	reopenAttempts int
+	failFirst      bool
+}
+
+func (f *fakeReopener) Reopen() (deviceIo, error) {
+	f.reopenAttempts++
+	if f.failFirst && f.reopenAttempts == 1 {
+		return nil, errors.New("still disconnected")
+	}
+	return &fakeReopener{deviceIo: f.deviceIo}, nil
+}
+
+func TestDrainPendingFailsAllOps(t *testing.T) {
+	h := new(commandHandler)
+	h.workCond = nil // drainPending doesn't touch workCond.
+
+	readCh := make(chan opResult, 1)
+	writeCh := make(chan opResult, 1)
+	h.pendingReads = []pendingOp{{command: "S1Z1RT?", ch: readCh}}
+	h.pendingWrites = []pendingOp{{command: "S1MODE!COOL", ch: writeCh}}
+
+	wantErr := errors.New("disconnected")
+	h.drainPending(wantErr)
+
+	if len(h.pendingReads) != 0 || len(h.pendingWrites) != 0 {
+		t.Errorf("Expected pending queues to be cleared, got reads=%v writes=%v", h.pendingReads, h.pendingWrites)
+	}
+	if res := <-readCh; res.err != wantErr {
+		t.Errorf("Got read err %v, want %v", res.err, wantErr)
+	}
+	if res := <-writeCh; res.err != wantErr {
+		t.Errorf("Got write err %v, want %v", res.err, wantErr)
+	}
+}
+
+func TestReconnectRetriesUntilSuccess(t *testing.T) {
+	h := new(commandHandler)
+	h.connected = true
+	device := &fakeReopener{failFirst: true}
+
+	h.reconnect(device, errors.New("ReadString: EOF"))
+
+	if !h.isConnected() {
+		t.Error("Expected isConnected() to be true after a successful reconnect")
+	}
+	if device.reopenAttempts < 2 {
+		t.Errorf("Expected Reopen to be retried after failing once, got %d attempt(s)", device.reopenAttempts)
+	}
+	if h.currentDevice() == nil {
+		t.Error("Expected currentDevice() to return the reopened device")
+	}
+}
+
+// TestAddOpFailsFastWhenDisconnected guards against a regression where a
+// known outage (isConnected() == false) still queues ops behind the full
+// device-timeout retry path instead of failing immediately.
+func TestAddOpFailsFastWhenDisconnected(t *testing.T) {
+	h := new(commandHandler)
+	h.connected = false
+
+	ch, _ := h.addOp("S1Z1RT?")
+	select {
+	case res := <-ch:
+		if res.err == nil {
+			t.Error("Expected addOp to fail fast with an error while disconnected, got nil error")
+		}
+	case <-time.After(50 * time.Millisecond):
+		t.Error("Expected addOp to return immediately while disconnected, but it blocked")
+	}
+	if len(h.pendingReads) != 0 {
+		t.Errorf("Expected op not to be queued while disconnected, got pendingReads=%v", h.pendingReads)
+	}
+}
+
+// TestReconnectWithoutReopenerDrainsAndStaysDisconnected guards against a
+// regression to log.Fatalf: a deviceIo that can't reopen itself must drain
+// pending ops and leave the handler marked disconnected, not kill the
+// process.
+func TestReconnectWithoutReopenerDrainsAndStaysDisconnected(t *testing.T) {
+	h := new(commandHandler)
+	h.connected = true
+
+	readCh := make(chan opResult, 1)
+	h.pendingReads = []pendingOp{{command: "S1Z1RT?", ch: readCh}}
+
+	wantErr := errors.New("ReadString: EOF")
+	done := make(chan struct{})
+	go func() {
+		h.reconnect(newFakeDevice(), wantErr) // newFakeDevice doesn't implement reopener.
+		close(done)
+	}()
+
+	if res := <-readCh; res.err != wantErr {
+		t.Errorf("Got read err %v, want %v", res.err, wantErr)
+	}
+	if h.isConnected() {
+		t.Error("Expected isConnected() to be false after a reconnect with no reopener")
+	}
+	select {
+	case <-done:
+		t.Error("Expected reconnect to block forever with no way to reopen the device")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,227 @@
+// This file generalizes the single commandHandler into a registry that
+// manages several independent Evolution SAM devices (e.g. an "upstairs" and
+// a "downstairs" system), each with its own command queue and processing
+// goroutine, and routes HTTP requests to the right one.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v3"
+)
+
+// deviceConfig describes one Evolution SAM module to manage.
+type deviceConfig struct {
+	// Name addresses the device under /devices/{name}/...
+	Name string `yaml:"name"`
+
+	// TTY and Baud identify the serial connection to open.
+	TTY  string `yaml:"tty"`
+	Baud int    `yaml:"baud"`
+
+	// System is the Evolution system id this device answers to, e.g. "1"
+	// for S1. Used to route the raw /command escape hatch by body content.
+	System string `yaml:"system"`
+
+	// Zones to poll for this device, e.g. ["1", "2"].
+	Zones []string `yaml:"zones"`
+}
+
+// registryConfig is the shape of the YAML file passed via -config.
+type registryConfig struct {
+	Devices []deviceConfig `yaml:"devices"`
+}
+
+// loadRegistryConfig reads and parses a multi-device YAML config file.
+func loadRegistryConfig(path string) (*registryConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	var cfg registryConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// registry owns a set of independently-managed devices and routes HTTP
+// requests to the right one, either by an explicit /devices/{name}/...
+// path prefix or, for the raw /command escape hatch, by the S{n} system id
+// embedded in the command body.
+type registry struct {
+	mu       sync.RWMutex
+	byName   map[string]*commandHandler
+	bySystem map[string]*commandHandler
+}
+
+func newRegistry() *registry {
+	return &registry{
+		byName:   make(map[string]*commandHandler),
+		bySystem: make(map[string]*commandHandler),
+	}
+}
+
+// add registers a configured device's handler under both its name and its
+// system id.
+func (reg *registry) add(cfg deviceConfig, h *commandHandler) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.byName[cfg.Name] = h
+	reg.bySystem[cfg.System] = h
+}
+
+func (reg *registry) device(name string) (*commandHandler, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	h, ok := reg.byName[name]
+	return h, ok
+}
+
+func (reg *registry) deviceForSystem(system string) (*commandHandler, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	h, ok := reg.bySystem[system]
+	return h, ok
+}
+
+// soleDevice returns the registry's only device, if it manages exactly
+// one. Used to keep the root-level routes (the single-device API surface
+// predating the registry) working when there's no ambiguity about which
+// device they address.
+func (reg *registry) soleDevice() (*commandHandler, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	if len(reg.byName) != 1 {
+		return nil, false
+	}
+	for _, h := range reg.byName {
+		return h, true
+	}
+	return nil, false
+}
+
+// deviceMux builds the same routes exportRegistryHandler mounts at root for
+// a sole device, plus a /command bound directly to this device, for use
+// under a /devices/{name} prefix.
+func deviceMux(h *commandHandler) http.Handler {
+	m := http.NewServeMux()
+	m.Handle("/command", h)
+	m.Handle("/systems/", &restHandler{cmd: h})
+	m.HandleFunc("/state", handleState(h.state))
+	m.HandleFunc("/events", handleEvents(h.state))
+	m.HandleFunc("/healthz", handleHealthz(h))
+	return m
+}
+
+var devicePathRe = regexp.MustCompile(`^/devices/([^/]+)(/.*)$`)
+
+// ServeHTTP implements /devices/{name}/... routing: it looks up the named
+// device and re-dispatches the request, with the name prefix stripped, to
+// that device's own routes.
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := devicePathRe.FindStringSubmatch(r.URL.Path)
+	if parts == nil {
+		http.NotFound(w, r)
+		return
+	}
+	name, rest := parts[1], parts[2]
+	h, ok := reg.device(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown device %q", name), http.StatusNotFound)
+		return
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = rest
+	deviceMux(h).ServeHTTP(w, r2)
+}
+
+var systemIDRe = regexp.MustCompile(`^S([0-9]+)`)
+
+// ServeCommand implements the raw /command escape hatch shared across all
+// devices: it parses the leading S{n} system id out of the body and routes
+// to whichever configured device answers to that system.
+func (reg *registry) ServeCommand(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	parts := systemIDRe.FindStringSubmatch(string(body))
+	if parts == nil {
+		http.Error(w, fmt.Sprintf("could not determine system id from command %q", body), http.StatusBadRequest)
+		return
+	}
+	h, ok := reg.deviceForSystem(parts[1])
+	if !ok {
+		http.Error(w, fmt.Sprintf("no device configured for system %q", parts[1]), http.StatusNotFound)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	h.ServeHTTP(w, r)
+}
+
+// buildRegistry opens every configured device and starts its command
+// processing goroutine and poller, returning a registry ready to serve.
+func buildRegistry(cfgs []deviceConfig, pollInterval, cacheTTL time.Duration) (*registry, error) {
+	reg := newRegistry()
+	for _, cfg := range cfgs {
+		baud := cfg.Baud
+		if baud == 0 {
+			baud = 9600
+		}
+		dev, err := openSerialDevice(cfg.TTY, baud)
+		if err != nil {
+			return nil, fmt.Errorf("device %q: %w", cfg.Name, err)
+		}
+		h := new(commandHandler)
+		h.name = cfg.Name
+		h.Open(dev)
+		h.cacheTTL = cacheTTL
+		h.startPolling(cfg.System, cfg.Zones, pollInterval)
+		reg.add(cfg, h)
+	}
+	return reg, nil
+}
+
+// exportRegistryHandler mounts /devices/{name}/... routing for every
+// managed device alongside the shared /command escape hatch. When the
+// registry manages exactly one device (the common case: no -config, or a
+// config with a single entry), it also mounts that device's routes at
+// root, so the pre-registry API surface (/systems/..., /state, /events,
+// /healthz) keeps working unchanged. Root /command is always the shared
+// escape hatch, so it only reaches a device whose system id matches the
+// S{n} prefix of the command body.
+func exportRegistryHandler(reg *registry) *http.Server {
+	m := http.NewServeMux()
+	m.Handle("/devices/", reg)
+	m.HandleFunc("/command", reg.ServeCommand)
+	m.Handle("/metrics", promhttp.Handler())
+
+	if h, ok := reg.soleDevice(); ok {
+		m.Handle("/systems/", &restHandler{cmd: h})
+		m.HandleFunc("/state", handleState(h.state))
+		m.HandleFunc("/events", handleEvents(h.state))
+		m.HandleFunc("/healthz", handleHealthz(h))
+	}
+
+	srv := &http.Server{
+		Addr:         ":8080",
+		ReadTimeout:  20 * time.Second,
+		WriteTimeout: 85 * time.Second,
+		Handler:      m,
+	}
+	srv.SetKeepAlivesEnabled(false)
+	return srv
+}
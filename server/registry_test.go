@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T) (*registry, *fakeDevice) {
+	t.Helper()
+	fakeDevice := newFakeDevice()
+	fakeDevice.start()
+
+	handler := new(commandHandler)
+	handler.Open(fakeDevice)
+
+	reg := newRegistry()
+	reg.add(deviceConfig{Name: "upstairs", System: "1"}, handler)
+	return reg, fakeDevice
+}
+
+func TestRegistryRoutesByDeviceName(t *testing.T) {
+	reg, fakeDevice := newTestRegistry(t)
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	go func() {
+		cmd := <-fakeDevice.testCommandChan
+		if cmd != "S1Z1RT?" {
+			t.Errorf("Expected 'S1Z1RT?', got '%s'", cmd)
+		}
+		fakeDevice.testResponseChan <- "S1Z1RT:72\xF8F"
+	}()
+
+	resp, err := http.Get(server.URL + "/devices/upstairs/systems/1/zones/1/temperature")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestRegistryUnknownDeviceName(t *testing.T) {
+	reg, _ := newTestRegistry(t)
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/devices/basement/command")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Got status %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestRegistryRoutesCommandBySystemID(t *testing.T) {
+	reg, fakeDevice := newTestRegistry(t)
+	server := httptest.NewServer(http.HandlerFunc(reg.ServeCommand))
+	defer server.Close()
+
+	go func() {
+		cmd := <-fakeDevice.testCommandChan
+		if cmd != "S1Z1RT?" {
+			t.Errorf("Expected 'S1Z1RT?', got '%s'", cmd)
+		}
+		fakeDevice.testResponseChan <- "S1Z1RT:72\xF8F"
+	}()
+
+	resp, err := http.Post(server.URL, "text/plain", strings.NewReader("S1Z1RT?"))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `{"response": "72F"}`) {
+		t.Errorf("Got body %q", string(body))
+	}
+}
+
+func TestExportRegistryHandlerMountsRootRoutesForSoleDevice(t *testing.T) {
+	reg, _ := newTestRegistry(t)
+	server := httptest.NewServer(exportRegistryHandler(reg).Handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz: got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestExportRegistryHandlerSkipsRootRoutesForMultipleDevices(t *testing.T) {
+	reg, fakeDevice := newTestRegistry(t)
+	second := new(commandHandler)
+	second.Open(fakeDevice)
+	reg.add(deviceConfig{Name: "downstairs", System: "2"}, second)
+
+	server := httptest.NewServer(exportRegistryHandler(reg).Handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /healthz with 2 devices: got status %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestRegistryRoutesCommandUnknownSystem(t *testing.T) {
+	reg, _ := newTestRegistry(t)
+	server := httptest.NewServer(http.HandlerFunc(reg.ServeCommand))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "text/plain", strings.NewReader("S9Z1RT?"))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Got status %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,228 @@
+// This file implements a structured REST/JSON API over the same
+// commandHandler used by the raw /command endpoint. It exists so that
+// integrations (Home Assistant, Homebridge, etc.) don't need to know the
+// Evolution ASCII protocol: paths and JSON bodies are translated to the
+// underlying Sn.../Z n... command strings, and responses are parsed back
+// into typed JSON rather than left as opaque payload strings.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Valid enum values for the Evolution protocol's MODE and FAN fields.
+var validModes = map[string]bool{"HEAT": true, "COOL": true, "AUTO": true, "OFF": true, "EHEAT": true}
+var validFanModes = map[string]bool{"AUTO": true, "LOW": true, "MED": true, "HIGH": true}
+
+// Setpoints are expressed in whole-degree Fahrenheit; this range matches
+// the limits enforced by the thermostat itself.
+const (
+	minSetpoint = 55
+	maxSetpoint = 99
+)
+
+var (
+	zoneTemperatureRe = regexp.MustCompile(`^/systems/([0-9]+)/zones/([0-9]+)/temperature$`)
+	zoneFanRe         = regexp.MustCompile(`^/systems/([0-9]+)/zones/([0-9]+)/fan$`)
+	zoneCoolSetpnReq  = regexp.MustCompile(`^/systems/([0-9]+)/zones/([0-9]+)/setpoints/cool$`)
+	zoneHeatSetpnReq  = regexp.MustCompile(`^/systems/([0-9]+)/zones/([0-9]+)/setpoints/heat$`)
+	systemModeRe      = regexp.MustCompile(`^/systems/([0-9]+)/mode$`)
+)
+
+// restHandler routes requests under /systems/... to per-resource handlers,
+// each of which validates its input and translates it to an evoRequest
+// executed against cmd.
+type restHandler struct {
+	cmd *commandHandler
+}
+
+func (rh *restHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.Method == http.MethodGet && zoneTemperatureRe.MatchString(r.URL.Path):
+		rh.readZoneField(w, zoneTemperatureRe.FindStringSubmatch(r.URL.Path), "RT", "temperature", parseTemperature)
+	case r.Method == http.MethodGet && zoneFanRe.MatchString(r.URL.Path):
+		rh.readZoneField(w, zoneFanRe.FindStringSubmatch(r.URL.Path), "FAN", "fan", parseEnum)
+	case r.Method == http.MethodPut && zoneFanRe.MatchString(r.URL.Path):
+		rh.writeZoneField(w, r, zoneFanRe.FindStringSubmatch(r.URL.Path), "FAN", "fan", validateFanMode, rawEnum)
+	case r.Method == http.MethodGet && zoneCoolSetpnReq.MatchString(r.URL.Path):
+		rh.readZoneField(w, zoneCoolSetpnReq.FindStringSubmatch(r.URL.Path), "CLSP", "setpoint", parseTemperature)
+	case r.Method == http.MethodPut && zoneCoolSetpnReq.MatchString(r.URL.Path):
+		rh.writeZoneField(w, r, zoneCoolSetpnReq.FindStringSubmatch(r.URL.Path), "CLSP", "setpoint", validateSetpoint, rawTemperature)
+	case r.Method == http.MethodGet && zoneHeatSetpnReq.MatchString(r.URL.Path):
+		rh.readZoneField(w, zoneHeatSetpnReq.FindStringSubmatch(r.URL.Path), "HTSP", "setpoint", parseTemperature)
+	case r.Method == http.MethodPut && zoneHeatSetpnReq.MatchString(r.URL.Path):
+		rh.writeZoneField(w, r, zoneHeatSetpnReq.FindStringSubmatch(r.URL.Path), "HTSP", "setpoint", validateSetpoint, rawTemperature)
+	case r.Method == http.MethodGet && systemModeRe.MatchString(r.URL.Path):
+		rh.readSystemField(w, systemModeRe.FindStringSubmatch(r.URL.Path), "MODE", "mode", parseEnum)
+	case r.Method == http.MethodPut && systemModeRe.MatchString(r.URL.Path):
+		rh.writeSystemField(w, r, systemModeRe.FindStringSubmatch(r.URL.Path), "MODE", "mode", validateMode, rawEnum)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// parseTemperature parses a payload like "72F" into 72.
+func parseTemperature(payload string) (interface{}, error) {
+	n, err := strconv.Atoi(strings.TrimSuffix(payload, "F"))
+	if err != nil {
+		return nil, fmt.Errorf("unparseable temperature %q", payload)
+	}
+	return n, nil
+}
+
+// parseEnum passes an enum payload (e.g., "HEAT", "AUTO") through unchanged.
+func parseEnum(payload string) (interface{}, error) {
+	return payload, nil
+}
+
+// rawTemperature is parseTemperature's inverse: it formats a validated
+// setpoint value back into the raw device payload form (e.g. "72" ->
+// "72F"), so a write caches the same representation a read would.
+func rawTemperature(value string) string {
+	return value + "F"
+}
+
+// rawEnum is parseEnum's inverse: enum payloads round-trip unchanged.
+func rawEnum(value string) string {
+	return value
+}
+
+// validateSetpoint rejects setpoints outside the range the thermostat will
+// accept, before the command is ever enqueued.
+func validateSetpoint(value string) (string, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return "", fmt.Errorf("setpoint %q is not an integer", value)
+	}
+	if n < minSetpoint || n > maxSetpoint {
+		return "", fmt.Errorf("setpoint %d outside valid range [%d, %d]", n, minSetpoint, maxSetpoint)
+	}
+	return strconv.Itoa(n), nil
+}
+
+// validateMode rejects anything other than a known HVAC mode.
+func validateMode(value string) (string, error) {
+	if !validModes[value] {
+		return "", fmt.Errorf("unknown mode %q", value)
+	}
+	return value, nil
+}
+
+// validateFanMode rejects anything other than a known fan mode.
+func validateFanMode(value string) (string, error) {
+	if !validFanModes[value] {
+		return "", fmt.Errorf("unknown fan mode %q", value)
+	}
+	return value, nil
+}
+
+// readZoneField serves a single zone field, preferring a fresh cache entry
+// over a device round-trip, and writes the parsed value back as
+// `{"<field>": <value>}`.
+func (rh *restHandler) readZoneField(w http.ResponseWriter, pathParts []string, verb, field string, parse func(string) (interface{}, error)) {
+	sys, zone := pathParts[1], pathParts[2]
+	cmd := evoRequest(fmt.Sprintf("S%sZ%s%s?", sys, zone, verb))
+	rh.readField(w, cmd, zoneKey(sys, zone, verb), field, parse)
+}
+
+// readSystemField is readZoneField's system-scoped (non-zone) counterpart.
+func (rh *restHandler) readSystemField(w http.ResponseWriter, pathParts []string, verb, field string, parse func(string) (interface{}, error)) {
+	sys := pathParts[1]
+	cmd := evoRequest(fmt.Sprintf("S%s%s?", sys, verb))
+	rh.readField(w, cmd, systemKey(sys, verb), field, parse)
+}
+
+func (rh *restHandler) readField(w http.ResponseWriter, cmd evoRequest, key, field string, parse func(string) (interface{}, error)) {
+	payload, cached := rh.cmd.state.get(key, rh.cmd.cacheTTL)
+	if !cached {
+		resp, err := rh.cmd.execute(cmd)
+		if !writeDeviceError(w, cmd, err) {
+			return
+		}
+		payload = resp.payload
+		rh.cmd.state.set(key, payload)
+	}
+	value, err := parse(payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{field: value})
+}
+
+// writeZoneField validates the JSON body `{"<field>": "<value>"}`, and, if
+// valid, issues the corresponding write command for a single zone. toRaw
+// converts the validated value to the same raw payload representation a
+// device read of the same key would produce, so the cache stays consistent
+// regardless of whether it was last populated by a read or a write.
+func (rh *restHandler) writeZoneField(w http.ResponseWriter, r *http.Request, pathParts []string, verb, field string, validate func(string) (string, error), toRaw func(string) string) {
+	sys, zone := pathParts[1], pathParts[2]
+	rh.writeField(w, r, func(value string) evoRequest {
+		return evoRequest(fmt.Sprintf("S%sZ%s%s!%s", sys, zone, verb, value))
+	}, zoneKey(sys, zone, verb), field, validate, toRaw)
+}
+
+// writeSystemField is writeZoneField's system-scoped (non-zone) counterpart.
+func (rh *restHandler) writeSystemField(w http.ResponseWriter, r *http.Request, pathParts []string, verb, field string, validate func(string) (string, error), toRaw func(string) string) {
+	sys := pathParts[1]
+	rh.writeField(w, r, func(value string) evoRequest {
+		return evoRequest(fmt.Sprintf("S%s%s!%s", sys, verb, value))
+	}, systemKey(sys, verb), field, validate, toRaw)
+}
+
+func (rh *restHandler) writeField(w http.ResponseWriter, r *http.Request, buildCmd func(string) evoRequest, key, field string, validate func(string) (string, error), toRaw func(string) string) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	raw, ok := body[field]
+	if !ok {
+		http.Error(w, fmt.Sprintf("missing %q field", field), http.StatusBadRequest)
+		return
+	}
+
+	value, err := validate(fmt.Sprintf("%v", raw))
+	if err != nil {
+		// Reject before the command ever reaches the device queue.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cmd := buildCmd(value)
+	resp, err := rh.cmd.execute(cmd)
+	if !writeDeviceError(w, cmd, err) {
+		return
+	}
+	// Refresh the cache immediately with the value we just wrote, rather
+	// than waiting for the next poll to pick it up. Cache the raw payload
+	// form (toRaw), matching what a device read would store, so a later
+	// poll doesn't see a spurious change and re-publish an SSE event.
+	rh.cmd.state.set(key, toRaw(value))
+	json.NewEncoder(w).Encode(map[string]interface{}{field: value, "response": resp.payload})
+}
+
+// writeDeviceError maps a device-layer error to the appropriate HTTP status
+// code, writing the error response if present. It returns true if cmd
+// succeeded and the caller should continue.
+func writeDeviceError(w http.ResponseWriter, cmd evoRequest, err error) bool {
+	if err == nil {
+		return true
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case strings.Contains(err.Error(), "Timeout"):
+		status = http.StatusGatewayTimeout
+	case strings.Contains(err.Error(), "Rejected command"):
+		status = http.StatusUnprocessableEntity
+	}
+	http.Error(w, fmt.Sprintf("%v: %v", cmd, err), status)
+	return false
+}
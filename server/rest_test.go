@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestZoneTemperature(t *testing.T) {
+	fakeDevice := newFakeDevice()
+	fakeDevice.start()
+
+	handler := new(commandHandler)
+	handler.Open(fakeDevice)
+
+	server := httptest.NewServer(&restHandler{cmd: handler})
+	defer server.Close()
+
+	go func() {
+		cmd := <-fakeDevice.testCommandChan
+		if cmd != "S1Z1RT?" {
+			t.Errorf("Expected 'S1Z1RT?', got '%s'", cmd)
+		}
+		fakeDevice.testResponseChan <- "S1Z1RT:72\xF8F"
+	}()
+
+	resp, err := http.Get(server.URL + "/systems/1/zones/1/temperature")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+	body := make([]byte, 1024)
+	n, _ := resp.Body.Read(body)
+	if !strings.Contains(string(body[:n]), `"temperature":72`) {
+		t.Errorf("Got body %q, want it to contain temperature:72", string(body[:n]))
+	}
+}
+
+func TestRestSetpointValidation(t *testing.T) {
+	fakeDevice := newFakeDevice()
+	fakeDevice.start()
+
+	handler := new(commandHandler)
+	handler.Open(fakeDevice)
+
+	server := httptest.NewServer(&restHandler{cmd: handler})
+	defer server.Close()
+
+	// A setpoint outside the valid range must be rejected before it is ever
+	// sent to the device.
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/systems/1/zones/1/setpoints/cool",
+		strings.NewReader(`{"setpoint": 999}`))
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Got status %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	select {
+	case cmd := <-fakeDevice.testCommandChan:
+		t.Errorf("Expected no command sent to device, got %q", cmd)
+	default:
+	}
+}
+
+func TestRestWriteSetpointCachesSameRepresentationAsARead(t *testing.T) {
+	fakeDevice := newFakeDevice()
+	fakeDevice.start()
+
+	handler := new(commandHandler)
+	handler.Open(fakeDevice)
+
+	server := httptest.NewServer(&restHandler{cmd: handler})
+	defer server.Close()
+
+	go func() {
+		cmd := <-fakeDevice.testCommandChan
+		if cmd != "S1Z1CLSP!70" {
+			t.Errorf("Expected 'S1Z1CLSP!70', got '%s'", cmd)
+		}
+		fakeDevice.testResponseChan <- "S1Z1CLSP:ACK"
+	}()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/systems/1/zones/1/setpoints/cool",
+		strings.NewReader(`{"setpoint": 70}`))
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	// The cache must hold the same raw payload form a device read would
+	// have produced ("70F"), not the bare validated value ("70"), or the
+	// next poll will see a spurious change and fire a bogus SSE event.
+	payload, ok := handler.state.get(zoneKey("1", "1", "CLSP"), time.Minute)
+	if !ok || payload != "70F" {
+		t.Errorf("Got cached payload (%q, %v), want (\"70F\", true)", payload, ok)
+	}
+}
+
+func TestRestWriteMode(t *testing.T) {
+	fakeDevice := newFakeDevice()
+	fakeDevice.start()
+
+	handler := new(commandHandler)
+	handler.Open(fakeDevice)
+
+	server := httptest.NewServer(&restHandler{cmd: handler})
+	defer server.Close()
+
+	go func() {
+		cmd := <-fakeDevice.testCommandChan
+		if cmd != "S1MODE!COOL" {
+			t.Errorf("Expected 'S1MODE!COOL', got '%s'", cmd)
+		}
+		fakeDevice.testResponseChan <- "S1MODE:ACK"
+	}()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/systems/1/mode",
+		strings.NewReader(`{"mode": "COOL"}`))
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+}
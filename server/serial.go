@@ -0,0 +1,49 @@
+// This file implements the device connection used outside of tests: a
+// pure-Go serial port (rather than shelling out to `stty` and opening the
+// tty file directly), so the module builds and runs on non-Linux hosts,
+// and a Reopen method so commandHandler's supervisor can recover from a
+// dropped connection without restarting the process.
+package main
+
+import (
+	"bufio"
+	"fmt"
+
+	"go.bug.st/serial"
+)
+
+// serialDevice is a deviceIo backed by a pure-Go serial port.
+type serialDevice struct {
+	name string
+	mode *serial.Mode
+	port serial.Port
+	*bufio.ReadWriter
+}
+
+// openSerialDevice opens name at the given baud rate using the Evolution
+// SAM's fixed framing (8 data bits, no parity, one stop bit).
+func openSerialDevice(name string, baud int) (*serialDevice, error) {
+	mode := &serial.Mode{
+		BaudRate: baud,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+	port, err := serial.Open(name, mode)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", name, err)
+	}
+	return &serialDevice{
+		name:       name,
+		mode:       mode,
+		port:       port,
+		ReadWriter: bufio.NewReadWriter(bufio.NewReader(port), bufio.NewWriter(port)),
+	}, nil
+}
+
+// Reopen implements reopener: it closes the current port, if still open,
+// and opens a fresh one at the same name and settings.
+func (d *serialDevice) Reopen() (deviceIo, error) {
+	d.port.Close() // Best-effort; the port may already be gone.
+	return openSerialDevice(d.name, d.mode.BaudRate)
+}
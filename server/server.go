@@ -3,17 +3,17 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
@@ -81,10 +81,20 @@ type pendingOp struct {
 	// Command to execute, e.g., S1Z1FAN?
 	command evoRequest
 
+	// Correlation id propagated into device I/O log lines for this op.
+	reqID string
+
 	// Channel on which the result will be delivered, when available.
 	ch chan opResult
 }
 
+// reqIDCounter generates per-request correlation ids.
+var reqIDCounter uint64
+
+func nextRequestID() string {
+	return fmt.Sprintf("req-%d", atomic.AddUint64(&reqIDCounter, 1))
+}
+
 // Result of executing a command against the device. Sum type.
 type opResult struct {
 	// Response, on success (else nil).
@@ -97,28 +107,128 @@ type opResult struct {
 // commandHandler implements an HTTP handler that exposes the device ASCII
 // protocol.
 type commandHandler struct {
+	// name identifies this device in metrics and log lines, e.g. "upstairs".
+	// Left blank outside of registry-managed setups (e.g. in tests).
+	name string
+
 	// Pending operations and concurrency control for them.
 	mu            sync.Mutex
 	workCond      *sync.Cond
 	pendingReads  []pendingOp
 	pendingWrites []pendingOp
+
+	// Cache of polled/written device state, and how long a cached read may
+	// be served before it must be refreshed from the device.
+	state    *deviceState
+	cacheTTL time.Duration
+
+	// Active device connection and its health, guarded separately from mu
+	// since they're read on every op but only written on reconnect.
+	connMu    sync.RWMutex
+	device    deviceIo
+	connected bool
+}
+
+// reopener is implemented by a deviceIo that knows how to close and reopen
+// its underlying connection. commandHandler uses it to recover from a
+// dropped connection (e.g., a transient USB disconnect) instead of killing
+// the process.
+type reopener interface {
+	Reopen() (deviceIo, error)
+}
+
+// currentDevice returns the active device connection.
+func (h *commandHandler) currentDevice() deviceIo {
+	h.connMu.RLock()
+	defer h.connMu.RUnlock()
+	return h.device
+}
+
+// isConnected reports whether the device connection is currently believed
+// healthy, for /healthz.
+func (h *commandHandler) isConnected() bool {
+	h.connMu.RLock()
+	defer h.connMu.RUnlock()
+	return h.connected
+}
+
+// reconnect fails every pending operation with err, then, if device
+// supports it, repeatedly calls Reopen with exponential backoff until it
+// succeeds, installing the result as the new current device. If device
+// doesn't support reopening, there is no way to recover: it drains pending
+// ops, leaves the handler marked disconnected, and blocks forever rather
+// than killing the process or spinning on the broken connection.
+func (h *commandHandler) reconnect(device deviceIo, err error) {
+	h.connMu.Lock()
+	h.connected = false
+	h.connMu.Unlock()
+
+	h.drainPending(err)
+
+	ro, ok := device.(reopener)
+	if !ok {
+		slog.Error("device read failed and does not support reconnecting; giving up", "device", h.name, "err", err)
+		select {}
+	}
+	slog.Warn("device read failed; reconnecting", "device", h.name, "err", err)
+
+	const maxBackoff = 30 * time.Second
+	backoff := time.Second
+	for {
+		newDevice, rerr := ro.Reopen()
+		if rerr == nil {
+			h.connMu.Lock()
+			h.device = newDevice
+			h.connected = true
+			h.connMu.Unlock()
+			slog.Info("reconnected to device", "device", h.name)
+			return
+		}
+		slog.Warn("reconnect failed", "device", h.name, "err", rerr, "retry_in", backoff)
+		time.Sleep(backoff)
+		if backoff < maxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// drainPending fails every currently pending operation with err, so callers
+// blocked waiting on a response don't hang for the duration of a reconnect.
+func (h *commandHandler) drainPending(err error) {
+	h.mu.Lock()
+	ops := append(h.pendingReads, h.pendingWrites...)
+	h.pendingReads = nil
+	h.pendingWrites = nil
+	h.updatePendingGauges()
+	h.mu.Unlock()
+
+	for _, op := range ops {
+		op.ch <- opResult{nil, err}
+		close(op.ch)
+	}
 }
 
 // Starts the handler.
 func (h *commandHandler) Open(device deviceIo) {
 	h.workCond = sync.NewCond(&h.mu)
+	h.state = newDeviceState()
+	h.device = device
+	h.connected = true
 
-	// Goroutine to handle raw reads.
+	// Goroutine to handle raw reads, reconnecting the device on error
+	// rather than killing the process.
 	respCh := make(chan string)
 	go func() {
 		for {
-			resp, err := device.ReadString('\n')
+			dev := h.currentDevice()
+			resp, err := dev.ReadString('\n')
 			if err != nil {
-				log.Fatalf("ReadString: %v", err)
+				h.reconnect(dev, err)
+				continue
 			}
 			resp = strings.TrimSpace(resp)
 			if resp != "" {
-				log.Printf("ReadString: %v", resp)
+				slog.Debug("device read", "device", h.name, "raw", resp)
 				respCh <- resp
 			}
 		}
@@ -134,9 +244,12 @@ func (h *commandHandler) Open(device deviceIo) {
 				const numCommandRetries = 3
 				var lastError error = nil
 				for i := 0; i < numCommandRetries; i++ {
-					res, err := execCommand(device, respCh, op.command)
+					res, err := execCommand(h.name, op.reqID, h.currentDevice(), respCh, op.command)
 					if err != nil {
-						log.Printf("(error on attempt count %v): %v", i, err)
+						if i < numCommandRetries-1 {
+							commandRetriesTotal.WithLabelValues(h.name, cmdType(op.command)).Inc()
+						}
+						slog.Warn("command attempt failed", "req_id", op.reqID, "device", h.name, "cmd", op.command, "attempt", i, "err", err)
 						lastError = err
 						continue
 					}
@@ -144,7 +257,7 @@ func (h *commandHandler) Open(device deviceIo) {
 					close(op.ch)
 					return
 				}
-				log.Printf("Permanent failure sending command %v", op.command)
+				slog.Error("command permanently failed", "req_id", op.reqID, "device", h.name, "cmd", op.command)
 				op.ch <- opResult{nil, lastError}
 				close(op.ch)
 			}()
@@ -152,10 +265,12 @@ func (h *commandHandler) Open(device deviceIo) {
 	}()
 }
 
-// Executes `cmd` against the device.
-func execCommand(deviceWriter deviceIo, deviceReader <-chan string, cmd evoRequest) (*evoResponse, error) {
+// Executes `cmd` against the device, logging under reqID, the correlation id
+// assigned when the op was enqueued, and recording metrics under deviceName.
+func execCommand(deviceName, reqID string, deviceWriter deviceIo, deviceReader <-chan string, cmd evoRequest) (*evoResponse, error) {
 	// Device spec promises a response within 5 seconds.
 	var commandTimeout = 6 * time.Second
+	start := time.Now()
 
 	// Send the command
 	deviceWriter.WriteString(fmt.Sprintf("%s\n", cmd))
@@ -163,12 +278,39 @@ func execCommand(deviceWriter deviceIo, deviceReader <-chan string, cmd evoReque
 
 	select {
 	case rawResp := <-deviceReader:
-		return parseEvoResponse(rawResp, cmd)
+		resp, err := parseEvoResponse(rawResp, cmd)
+		recordCommandOutcome(deviceName, cmd, err, time.Since(start))
+		if err != nil {
+			slog.Warn("command rejected or unparseable", "req_id", reqID, "device", deviceName, "cmd", cmd, "raw_response", rawResp, "err", err)
+		} else {
+			slog.Debug("command acked", "req_id", reqID, "device", deviceName, "cmd", cmd, "response", resp.payload)
+		}
+		return resp, err
 	case <-time.After(commandTimeout):
+		commandsTotal.WithLabelValues(deviceName, cmdType(cmd), "timeout").Inc()
+		slog.Warn("command timeout", "req_id", reqID, "device", deviceName, "cmd", cmd)
 		return nil, fmt.Errorf("Timeout: %v", cmd)
 	}
 }
 
+// recordCommandOutcome updates the commands/latency/parse-error metrics for
+// one non-timeout execCommand attempt.
+func recordCommandOutcome(deviceName string, cmd evoRequest, err error, latency time.Duration) {
+	deviceLatencySeconds.WithLabelValues(deviceName).Observe(latency.Seconds())
+
+	outcome := "ack"
+	switch {
+	case err == nil:
+		outcome = "ack"
+	case strings.Contains(err.Error(), "Rejected command"):
+		outcome = "nak"
+	default:
+		outcome = "error"
+		parseErrorsTotal.WithLabelValues(deviceName).Inc()
+	}
+	commandsTotal.WithLabelValues(deviceName, cmdType(cmd), outcome).Inc()
+}
+
 // blockForNextOp returns the next operation to execute, blocking until one
 // is available.
 func (h *commandHandler) blockForNextOp() pendingOp {
@@ -185,35 +327,64 @@ func (h *commandHandler) blockForNextOp() pendingOp {
 	// changing the temperature), and executing operations in a strict FIFO
 	// order can result in annoyingly long delays, since the device takes
 	// ~1.5s to execute one operation.
+	var op pendingOp
 	if len(h.pendingWrites) > 0 {
 		// Handle write
-		op := h.pendingWrites[0]
+		op = h.pendingWrites[0]
 		h.pendingWrites = h.pendingWrites[1:]
-		return op
 	} else if len(h.pendingReads) > 0 {
 		// Handle read.
-		op := h.pendingReads[0]
+		op = h.pendingReads[0]
 		h.pendingReads = h.pendingReads[1:]
-		return op
 	} else {
 		panic("No work on wakeup")
 	}
+	h.updatePendingGauges()
+	return op
 }
 
-// addOp adds a new pending operation for cmd to the set of pending operations
-// and returns the channel on which the result will eventually be written.
-func (h *commandHandler) addOp(cmd evoRequest) <-chan opResult {
+// updatePendingGauges refreshes the queue-depth gauges. Callers must hold
+// h.mu.
+func (h *commandHandler) updatePendingGauges() {
+	pendingOpsGauge.WithLabelValues(h.name, "read").Set(float64(len(h.pendingReads)))
+	pendingOpsGauge.WithLabelValues(h.name, "write").Set(float64(len(h.pendingWrites)))
+}
+
+// addOp adds a new pending operation for cmd to the set of pending
+// operations and returns the channel on which the result will eventually be
+// written, along with the correlation id assigned to the op. If the device
+// is known to be disconnected, it fails fast with an error instead of
+// queuing the op behind the full device-timeout retry path, so an outage
+// doesn't back up the queue with requests that each take ~18s to fail.
+func (h *commandHandler) addOp(cmd evoRequest) (<-chan opResult, string) {
+	reqID := nextRequestID()
+	if !h.isConnected() {
+		ch := make(chan opResult, 1)
+		ch <- opResult{nil, fmt.Errorf("device disconnected")}
+		close(ch)
+		return ch, reqID
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	op := pendingOp{command: cmd, ch: make(chan opResult)}
+	op := pendingOp{command: cmd, reqID: reqID, ch: make(chan opResult)}
 	if cmd.isWrite() {
 		h.pendingWrites = append(h.pendingWrites, op)
 	} else {
 		h.pendingReads = append(h.pendingReads, op)
 	}
+	h.updatePendingGauges()
 	h.workCond.Broadcast()
-	return op.ch
+	return op.ch, op.reqID
+}
+
+// execute enqueues cmd and blocks until the device has produced a result
+// (or the command has permanently failed).
+func (h *commandHandler) execute(cmd evoRequest) (*evoResponse, error) {
+	resultCh, _ := h.addOp(cmd)
+	result := <-resultCh
+	return result.response, result.err
 }
 
 func (h *commandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -222,55 +393,71 @@ func (h *commandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	cmdBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Failed reading body: %v", err)
+		slog.Error("failed reading body", "device", h.name, "err", err)
 		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
 		return
 	}
 	cmd := evoRequest(string(cmdBytes))
 
-	resultCh := h.addOp(cmd)
+	resultCh, reqID := h.addOp(cmd)
 	result := <-resultCh
 	if result.err != nil {
-		// Error
-		log.Printf("Failed sending command %v: %v", cmd, result.err)
+		slog.Error("command failed", "req_id", reqID, "device", h.name, "cmd", cmd, "err", result.err)
 		http.Error(w, fmt.Sprintf("Failed to send %v: %v", cmd, result.err),
 			http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Command %v, Response: %v", cmd, result.response)
+	slog.Info("command completed", "req_id", reqID, "device", h.name, "cmd", cmd, "response", result.response.payload)
 	fmt.Fprintf(w, `{"response": "%s"}`+"\n", result.response.payload)
 }
 
-func exportNewHandler(device deviceIo) *http.Server {
-	handler := new(commandHandler)
-	handler.Open(device)
-	m := http.NewServeMux()
-	m.Handle("/command", handler)
-
-	srv := &http.Server{
-		Addr:         ":8080",
-		ReadTimeout:  20 * time.Second,
-		WriteTimeout: 85 * time.Second,
-		Handler:      m,
+// handleHealthz serves GET /healthz: 200 if the device connection is
+// currently up, 503 (with the same JSON shape) if it's mid-reconnect.
+func handleHealthz(h *commandHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !h.isConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, `{"connected": false}`)
+			return
+		}
+		fmt.Fprintln(w, `{"connected": true}`)
 	}
-	srv.SetKeepAlivesEnabled(false)
-	return srv
 }
 
 func main() {
-	device := flag.String("device", "/dev/ttyUSB0", "Name of file corresponding to device to control")
+	device := flag.String("device", "/dev/ttyUSB0", "Name of file corresponding to device to control (ignored if -config is set)")
+	baud := flag.Int("baud", 9600, "Baud rate for the serial connection to the device (ignored if -config is set)")
+	system := flag.String("system", "1", "Evolution system id to poll and expose, e.g. \"1\" for S1 (ignored if -config is set)")
+	zones := flag.String("zones", "1", "Comma-separated list of zone ids to poll, e.g. \"1,2\" (ignored if -config is set)")
+	configPath := flag.String("config", "", "Path to a YAML file describing multiple devices; if unset, -device/-baud/-system/-zones configure a single device named \"default\"")
+	pollInterval := flag.Duration("poll-interval", 30*time.Second, "How often to refresh the polled device-state cache (0 disables polling)")
+	cacheTTL := flag.Duration("cache-ttl", 35*time.Second, "How long a cached read may be served before it is refreshed from the device (should be >= -poll-interval so reads are normally served from cache between polls)")
 	flag.Parse()
 
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	if err := exec.Command("stty", "-F", *device, "9600", "cs8", "-cstopb", "-parenb", "-echo").Run(); err != nil {
-		log.Fatalf("stty: %s", err)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	var cfgs []deviceConfig
+	if *configPath != "" {
+		rc, err := loadRegistryConfig(*configPath)
+		if err != nil {
+			log.Fatalf("loadRegistryConfig: %v", err)
+		}
+		cfgs = rc.Devices
+	} else {
+		cfgs = []deviceConfig{{
+			Name:   "default",
+			TTY:    *device,
+			Baud:   *baud,
+			System: *system,
+			Zones:  strings.Split(*zones, ","),
+		}}
 	}
-	ttyFile := "/dev/ttyUSB0"
-	serialFile, err := os.OpenFile(ttyFile, os.O_RDWR, 0)
+
+	reg, err := buildRegistry(cfgs, *pollInterval, *cacheTTL)
 	if err != nil {
-		log.Fatalf("OpenFile: %v", err)
+		log.Fatalf("buildRegistry: %v", err)
 	}
-	log.Printf("Opened device file: %v", ttyFile)
-	srv := exportNewHandler(bufio.NewReadWriter(bufio.NewReader(serialFile), bufio.NewWriter(serialFile)))
-	log.Fatal(srv.ListenAndServe())
+	slog.Info("managing devices", "count", len(cfgs))
+	log.Fatal(exportRegistryHandler(reg).ListenAndServe())
 }
@@ -0,0 +1,178 @@
+// This file implements a polled, cached view of device state: a background
+// poller keeps commonly-read fields warm so that HTTP reads can usually be
+// answered from memory instead of waiting out a ~1.5s device round-trip,
+// and an SSE stream lets clients watch for changes instead of polling the
+// HTTP API themselves.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cacheEntry is the most recently observed payload for one polled or
+// written resource.
+type cacheEntry struct {
+	payload string
+	updated time.Time
+}
+
+// deviceState is an in-memory cache of the most recently observed value for
+// each polled or written resource, guarded by mu, plus the set of SSE
+// subscribers to notify when a value changes.
+type deviceState struct {
+	mu          sync.Mutex
+	entries     map[string]cacheEntry
+	subscribers map[chan string]bool
+}
+
+func newDeviceState() *deviceState {
+	return &deviceState{
+		entries:     make(map[string]cacheEntry),
+		subscribers: make(map[chan string]bool),
+	}
+}
+
+// get returns the cached payload for key, if it is younger than ttl.
+func (d *deviceState) get(key string, ttl time.Duration) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, ok := d.entries[key]
+	if !ok || time.Since(entry.updated) > ttl {
+		return "", false
+	}
+	return entry.payload, true
+}
+
+// set stores payload for key and notifies subscribers, if it changed.
+func (d *deviceState) set(key, payload string) {
+	d.mu.Lock()
+	prev, existed := d.entries[key]
+	d.entries[key] = cacheEntry{payload: payload, updated: time.Now()}
+	subs := make([]chan string, 0, len(d.subscribers))
+	for ch := range d.subscribers {
+		subs = append(subs, ch)
+	}
+	d.mu.Unlock()
+
+	if existed && prev.payload == payload {
+		return
+	}
+	event := fmt.Sprintf(`{"key": %q, "value": %q}`, key, payload)
+	for _, ch := range subs {
+		select {
+		case ch <- event:
+		default: // Subscriber is behind; drop rather than block the poller/writer.
+		}
+	}
+}
+
+// snapshot returns a copy of all cached values, for GET /state.
+func (d *deviceState) snapshot() map[string]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]string, len(d.entries))
+	for k, v := range d.entries {
+		out[k] = v.payload
+	}
+	return out
+}
+
+// subscribe registers a new SSE subscriber, returning its event channel and
+// a function to unsubscribe and release it.
+//
+// unsubscribe deliberately does not close ch: set may already be about to
+// send on it (the channels are snapshotted outside mu), and a send on a
+// closed channel panics regardless of the select's default case. The
+// channel is simply dropped from the map and left for the garbage
+// collector; handleEvents's reader exits separately via r.Context().Done().
+func (d *deviceState) subscribe() (chan string, func()) {
+	ch := make(chan string, 16)
+	d.mu.Lock()
+	d.subscribers[ch] = true
+	d.mu.Unlock()
+	return ch, func() {
+		d.mu.Lock()
+		delete(d.subscribers, ch)
+		d.mu.Unlock()
+	}
+}
+
+// zoneKey and systemKey name cache entries consistently between the poller
+// and the REST handlers, so either one can populate a value the other
+// reads.
+func zoneKey(sys, zone, verb string) string { return fmt.Sprintf("%sZ%s%s", sys, zone, verb) }
+func systemKey(sys, verb string) string     { return fmt.Sprintf("%s%s", sys, verb) }
+
+// startPolling periodically re-reads the well-known fields (RT, CLSP, HTSP,
+// FAN per zone; MODE per system) and caches the results. Polls are enqueued
+// through the normal pending-op queue via execute, so they interleave with
+// user requests rather than contending with them directly: writes are
+// always preferred over reads in blockForNextOp, so a poll never starves a
+// user-initiated write.
+func (h *commandHandler) startPolling(system string, zones []string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			for _, zone := range zones {
+				for _, verb := range []string{"RT", "CLSP", "HTSP", "FAN"} {
+					h.poll(fmt.Sprintf("S%sZ%s%s?", system, zone, verb), zoneKey(system, zone, verb))
+				}
+			}
+			h.poll(fmt.Sprintf("S%sMODE?", system), systemKey(system, "MODE"))
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// poll executes cmd and, on success, stores its payload under key.
+func (h *commandHandler) poll(cmd, key string) {
+	resp, err := h.execute(evoRequest(cmd))
+	if err != nil {
+		slog.Warn("poll failed", "device", h.name, "cmd", cmd, "err", err)
+		return
+	}
+	h.state.set(key, resp.payload)
+}
+
+// handleState serves GET /state: a JSON snapshot of every cached value.
+func handleState(state *deviceState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state.snapshot())
+	}
+}
+
+// handleEvents serves GET /events: an SSE stream of `{"key", "value"}`
+// diffs, one per changed cache entry.
+func handleEvents(state *deviceState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ch, unsubscribe := state.subscribe()
+		defer unsubscribe()
+
+		for {
+			select {
+			case event := <-ch:
+				fmt.Fprintf(w, "data: %s\n\n", event)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
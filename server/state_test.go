@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeviceStateCacheExpiry(t *testing.T) {
+	state := newDeviceState()
+	state.set("1Z1RT", "72F")
+
+	if payload, ok := state.get("1Z1RT", time.Minute); !ok || payload != "72F" {
+		t.Errorf("Got (%q, %v), want (\"72F\", true)", payload, ok)
+	}
+	if _, ok := state.get("1Z1RT", 0); ok {
+		t.Errorf("Expected a zero TTL to treat the entry as stale")
+	}
+	if _, ok := state.get("missing", time.Minute); ok {
+		t.Errorf("Expected no entry for an unset key")
+	}
+}
+
+func TestDeviceStatePublishesOnChange(t *testing.T) {
+	state := newDeviceState()
+	ch, unsubscribe := state.subscribe()
+	defer unsubscribe()
+
+	state.set("1MODE", "HEAT")
+	select {
+	case event := <-ch:
+		if event != `{"key": "1MODE", "value": "HEAT"}` {
+			t.Errorf("Got event %q", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for change event")
+	}
+
+	// Setting the same value again should not publish a second event.
+	state.set("1MODE", "HEAT")
+	select {
+	case event := <-ch:
+		t.Errorf("Expected no event for an unchanged value, got %q", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestDeviceStateUnsubscribeDuringSetDoesNotPanic guards against a
+// send-on-closed-channel panic: a subscriber unsubscribing concurrently
+// with a set() must never make set() panic, even if set() still sends on
+// the channel that was just unsubscribed.
+func TestDeviceStateUnsubscribeDuringSetDoesNotPanic(t *testing.T) {
+	state := newDeviceState()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		_, unsubscribe := state.subscribe()
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			unsubscribe()
+		}()
+		go func() {
+			defer wg.Done()
+			state.set("1Z1RT", "72F")
+		}()
+	}
+	wg.Wait()
+}